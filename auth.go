@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// contextKey namespaces the values this package stores on a request
+// context so they can't collide with keys set by other packages.
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	sessionContextKey
+)
+
+// UserFromContext returns the *User stored by RequireAuth or LoadUser,
+// or nil if the request carried no authenticated session.
+func UserFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(userContextKey).(*User)
+	return u
+}
+
+// SessionFromContext returns the *Session stored by RequireAuth or
+// LoadUser, or nil if the request carried no authenticated session.
+func SessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionContextKey).(*Session)
+	return s
+}
+
+// withUserAndSession returns a copy of r whose context carries u and s.
+func withUserAndSession(r *http.Request, u *User, s *Session) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, u)
+	ctx = context.WithValue(ctx, sessionContextKey, s)
+	return r.WithContext(ctx)
+}
+
+// RequireAuth resolves the user and session for the request once,
+// storing them in the request context, and extends the session. If the
+// request has no valid session it redirects to /login?next=<originalURL>
+// instead of calling next.
+func RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, s, err := getUserAndSessionFromSessionCookie(r)
+		if err != nil {
+			redirectTo := "/login?next=" + url.QueryEscape(r.URL.RequestURI())
+			http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+			return
+		}
+		if err := sessionStore.Extend(w, r); err != nil {
+			log.Println("Unable to extend session:", err)
+		}
+		next.ServeHTTP(w, withUserAndSession(r, u, s))
+	})
+}
+
+// LoadUser populates the request context with the user and session if
+// the request carries a valid one, but does not require it. Use this on
+// public routes that render differently for logged-in visitors without
+// forcing them to authenticate.
+func LoadUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok := IsAuthenticated(sessionStore, w, r); ok {
+			if u, s, err := getUserAndSessionFromSessionCookie(r); err == nil {
+				r = withUserAndSession(r, u, s)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MaxLoginAttempts is how many failed login attempts a single key (an
+// email address or a client IP) may accrue within LoginThrottleWindow
+// before further attempts are blocked.
+const MaxLoginAttempts = 5
+
+// LoginThrottleWindow is the sliding window over which failed login
+// attempts are counted.
+const LoginThrottleWindow = 15 * time.Minute
+
+// loginThrottleSweepInterval controls how often the in-memory store's
+// background goroutine checks for expired windows.
+const loginThrottleSweepInterval = time.Minute
+
+// LoginThrottleStore is anything capable of counting failed login
+// attempts per key. The in-memory implementation below is fine for a
+// single instance; a Redis-backed implementation (counters with a TTL
+// matching LoginThrottleWindow, incremented via INCR/EXPIRE) can replace
+// it without the login handler needing to change.
+type LoginThrottleStore interface {
+	// Attempts returns the current failure count for key and how long
+	// remains before that count resets, without recording a new failure.
+	Attempts(key string) (count int, retryAfter time.Duration, err error)
+
+	// RecordFailure records a failed attempt for key and returns the
+	// updated count and the remaining window duration.
+	RecordFailure(key string) (count int, retryAfter time.Duration, err error)
+
+	// Reset clears any recorded failures for key.
+	Reset(key string) error
+}
+
+// attemptRecord tracks the failures seen for a single key within the
+// current window.
+type attemptRecord struct {
+	count     int
+	windowEnd time.Time
+}
+
+// MemoryLoginThrottleStore is a LoginThrottleStore backed by a plain
+// in-memory map. Like MemorySessionStore it does not survive a process
+// restart and is only visible to the process that created it.
+type MemoryLoginThrottleStore struct {
+	mu       sync.Mutex
+	attempts map[string]*attemptRecord
+	stop     chan struct{}
+}
+
+// NewMemoryLoginThrottleStore returns an initialised
+// MemoryLoginThrottleStore and starts its background sweeper.
+func NewMemoryLoginThrottleStore() *MemoryLoginThrottleStore {
+	s := &MemoryLoginThrottleStore{
+		attempts: map[string]*attemptRecord{},
+		stop:     make(chan struct{}),
+	}
+	go s.sweep()
+	return s
+}
+
+// Close stops the sweeper.
+func (s *MemoryLoginThrottleStore) Close() {
+	close(s.stop)
+}
+
+// Attempts returns the current failure count for key.
+func (s *MemoryLoginThrottleStore) Attempts(key string) (int, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.attempts[key]
+	if !ok || time.Now().After(rec.windowEnd) {
+		return 0, 0, nil
+	}
+	return rec.count, time.Until(rec.windowEnd), nil
+}
+
+// RecordFailure increments the failure count for key, starting a fresh
+// window if the previous one has expired.
+func (s *MemoryLoginThrottleStore) RecordFailure(key string) (int, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	rec, ok := s.attempts[key]
+	if !ok || now.After(rec.windowEnd) {
+		rec = &attemptRecord{windowEnd: now.Add(LoginThrottleWindow)}
+		s.attempts[key] = rec
+	}
+	rec.count++
+	return rec.count, time.Until(rec.windowEnd), nil
+}
+
+// Reset clears any recorded failures for key.
+func (s *MemoryLoginThrottleStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// sweep periodically evicts expired windows until the store is closed.
+func (s *MemoryLoginThrottleStore) sweep() {
+	ticker := time.NewTicker(loginThrottleSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.purgeExpired()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *MemoryLoginThrottleStore) purgeExpired() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, rec := range s.attempts {
+		if now.After(rec.windowEnd) {
+			delete(s.attempts, key)
+		}
+	}
+}
+
+// LoginThrottle guards the login handler against brute-force and
+// credential-stuffing attempts. Failures are tracked per email and per
+// client IP independently, so an attacker spraying one password across
+// many accounts is throttled by IP even though no single email ever
+// fails MaxLoginAttempts times, and an attacker hammering one account
+// from many IPs is throttled by email.
+type LoginThrottle struct {
+	Store LoginThrottleStore
+}
+
+// NewLoginThrottle returns a LoginThrottle backed by an in-memory store.
+func NewLoginThrottle() *LoginThrottle {
+	return &LoginThrottle{Store: NewMemoryLoginThrottleStore()}
+}
+
+// Allow reports whether a login attempt for email from ip should be
+// permitted to proceed. If not, retryAfter is how long the caller should
+// wait before trying again.
+func (t *LoginThrottle) Allow(email, ip string) (bool, time.Duration) {
+	var retryAfter time.Duration
+
+	for _, key := range throttleKeys(email, ip) {
+		count, remaining, err := t.Store.Attempts(key)
+		if err != nil {
+			continue
+		}
+		if count >= MaxLoginAttempts && remaining > retryAfter {
+			retryAfter = remaining
+		}
+	}
+	return retryAfter == 0, retryAfter
+}
+
+// RecordFailure records a failed login attempt against both email and ip.
+func (t *LoginThrottle) RecordFailure(email, ip string) {
+	for _, key := range throttleKeys(email, ip) {
+		t.Store.RecordFailure(key)
+	}
+}
+
+// Reset clears any recorded failures for both email and ip, called on a
+// successful login.
+func (t *LoginThrottle) Reset(email, ip string) {
+	for _, key := range throttleKeys(email, ip) {
+		t.Store.Reset(key)
+	}
+}
+
+// throttleKeys returns the store keys a login attempt is tracked under.
+func throttleKeys(email, ip string) []string {
+	return []string{"email:" + email, "ip:" + ip}
+}
+
+// clientIP returns the requesting client's address with any port
+// stripped, falling back to the raw RemoteAddr if it cannot be parsed.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -4,40 +4,167 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 )
 
 // Setup global variables for our sessions, users and templates.
 var tpl *template.Template
 var usersDB *UsersDB
-var sessionDB *SessionDB
+var sessionStore SessionStore
+var loginThrottle *LoginThrottle
 
 // init will initialise the sessions, users and templates.
 func init() {
-	tpl = template.Must(template.ParseGlob("./templates/*.html"))
+	tpl = template.Must(template.New("templates").Funcs(template.FuncMap{
+		"csrfField": csrfField,
+	}).ParseGlob("./templates/*.html"))
 	usersDB = &UsersDB{map[int]User{}}
-	sessionDB = &SessionDB{map[string]Session{}}
+	sessionStore = newSessionStoreFromEnv()
+	loginThrottle = NewLoginThrottle()
+}
+
+// newSessionStoreFromEnv selects a SessionStore implementation based on
+// the SESSION_STORE environment variable ("memory", "redis", "bbolt" or
+// "stateless"). It defaults to an in-memory store when unset.
+func newSessionStoreFromEnv() SessionStore {
+	switch os.Getenv("SESSION_STORE") {
+	case "redis":
+		return NewRedisSessionStore(os.Getenv("REDIS_ADDR"))
+	case "bbolt":
+		path := os.Getenv("BBOLT_PATH")
+		if path == "" {
+			path = "sessions.db"
+		}
+		store, err := NewBboltSessionStore(path)
+		if err != nil {
+			log.Fatal("Unable to open bbolt session store:", err)
+		}
+		return store
+	case "stateless":
+		signingKeys := splitEnvKeys("SESSION_SIGNING_KEYS")
+		if len(signingKeys) == 0 {
+			log.Fatal("SESSION_SIGNING_KEYS must be set when SESSION_STORE=stateless")
+		}
+		return &StatelessSessionDB{
+			SigningKeys:    signingKeys,
+			EncryptionKeys: splitEnvKeys("SESSION_ENCRYPTION_KEYS"),
+		}
+	default:
+		return NewMemorySessionStore()
+	}
+}
+
+// splitEnvKeys reads a comma-separated list of keys from the named
+// environment variable, newest first.
+func splitEnvKeys(name string) [][]byte {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return nil
+	}
+	parts := strings.Split(raw, ",")
+	keys := make([][]byte, 0, len(parts))
+	for _, p := range parts {
+		keys = append(keys, []byte(p))
+	}
+	return keys
 }
 
 // main is the main entry point to the application.
 // Defines the handlers and starts the server.
 func main() {
-	http.HandleFunc("/", index)
+	http.Handle("/", LoadUser(http.HandlerFunc(index)))
 	http.Handle("/favicon.ico", http.NotFoundHandler())
-	http.HandleFunc("/signup", signup)
-	http.HandleFunc("/login", login)
-	http.HandleFunc("/logout", logout)
-	http.HandleFunc("/account", account)
+	http.Handle("/signup", LoadUser(RequireCSRF(http.HandlerFunc(signup))))
+	http.Handle("/login", LoadUser(RequireCSRF(http.HandlerFunc(login))))
+	http.Handle("/logout", RequireAuth(RequireCSRF(http.HandlerFunc(logout))))
+	http.Handle("/account", RequireAuth(http.HandlerFunc(account)))
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
-// getUserAndSessionFromSessionCookie returns a User and Session object based on the request cookie.
-func getUserAndSessionFromSessionCookie(r *http.Request) (*User, *Session, error) {
-	// Get the Session from the SessionID in the cookie
+// currentSession returns the Session referenced by the request's session
+// cookie, if any.
+func currentSession(r *http.Request) (*Session, error) {
 	c, err := r.Cookie("session")
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	return sessionStore.Get(c.Value)
+}
+
+// ensureAnonymousSession returns the request's current session, or
+// creates a fresh one tied to no user (UserID 0) so that pre-auth pages
+// such as signup and login have somewhere to keep a CSRF token.
+//
+// Create only sets the session cookie on the response; since callers
+// (e.g. flashAndRedirect) go on to read the session back off r within
+// the same request, a freshly created session is also attached to r
+// itself so it's visible immediately rather than only on the client's
+// next request. r's Cookie header is replaced rather than appended to,
+// since r may already carry a stale or otherwise-unrecognised "session"
+// cookie (e.g. expired, or minted by another instance sharing no state
+// with this one) and Request.Cookie returns the first match, not the
+// last.
+func ensureAnonymousSession(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	if s, err := currentSession(r); err == nil {
+		return s, nil
 	}
-	s, err := sessionDB.Get(c.Value)
+	s, err := sessionStore.Create(w, r, 0)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Cookie", (&http.Cookie{Name: "session", Value: s.SessionID}).String())
+	return s, nil
+}
+
+// loginRedirectTarget returns where a successful (or already-logged-in)
+// login should redirect to: the "next" query parameter set by RequireAuth
+// when it bounced an unauthenticated request here, or /account if there
+// is none. Only same-site paths are honoured so "next" can't be abused
+// as an open redirect.
+func loginRedirectTarget(r *http.Request) string {
+	next := r.URL.Query().Get("next")
+	if next == "" || strings.HasPrefix(next, "//") {
+		return "/account"
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.IsAbs() || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return "/account"
+	}
+	return next
+}
+
+// loginPath returns the /login URL to redirect a failed submission back
+// to, preserving next (if it isn't the default /account) so the retry
+// still knows where to send the user afterwards.
+func loginPath(next string) string {
+	if next == "" || next == "/account" {
+		return "/login"
+	}
+	return "/login?next=" + url.QueryEscape(next)
+}
+
+// flashAndRedirect queues msg as an "error" flash on the request's (or a
+// freshly created anonymous) session, then issues a 303 redirect to
+// path. Used by form handlers so a failed submission survives a page
+// refresh instead of resubmitting the form.
+func flashAndRedirect(w http.ResponseWriter, r *http.Request, path string, msg string) {
+	if _, err := ensureAnonymousSession(w, r); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := sessionStore.AddFlash(r, "error", msg); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, path, http.StatusSeeOther)
+}
+
+// getUserAndSessionFromSessionCookie returns a User and Session object based on the request cookie.
+func getUserAndSessionFromSessionCookie(r *http.Request) (*User, *Session, error) {
+	s, err := currentSession(r)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -50,36 +177,39 @@ func getUserAndSessionFromSessionCookie(r *http.Request) (*User, *Session, error
 	return u, s, nil
 }
 
+// csrfField renders the hidden input forms must submit so RequireCSRF
+// can verify the request against the session's XSRFToken.
+func csrfField(s *Session) template.HTML {
+	if s == nil {
+		return ""
+	}
+	return template.HTML(`<input type="hidden" name="_csrf" value="` + template.HTMLEscapeString(s.XSRFToken) + `">`)
+}
+
 // index route handler.
 func index(w http.ResponseWriter, r *http.Request) {
-	// If the user is already authenticated then redirect.
-	if ok := sessionDB.IsAuthenticated(w, r); ok {
-		// Get the user out of the session
-		u, s, err := getUserAndSessionFromSessionCookie(r)
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-
-		// Return the account page.
-		tpl.ExecuteTemplate(w, "index.html", struct {
-			User       *User
-			Session    *Session
-			IsLoggedIn bool
-		}{
-			u,
-			s,
-			true,
-		})
+	u := UserFromContext(r.Context())
+	if u == nil {
+		tpl.ExecuteTemplate(w, "index.html", nil)
 		return
 	}
-	tpl.ExecuteTemplate(w, "index.html", nil)
+
+	// Return the logged-in variant of the page.
+	tpl.ExecuteTemplate(w, "index.html", struct {
+		User       *User
+		Session    *Session
+		IsLoggedIn bool
+	}{
+		u,
+		SessionFromContext(r.Context()),
+		true,
+	})
 }
 
 // signup route handler.
 func signup(w http.ResponseWriter, r *http.Request) {
 	// If the user is already authenticated then redirect.
-	if ok := sessionDB.IsAuthenticated(w, r); ok {
+	if UserFromContext(r.Context()) != nil {
 		http.Redirect(w, r, "/account", http.StatusSeeOther)
 		return
 	}
@@ -93,14 +223,12 @@ func signup(w http.ResponseWriter, r *http.Request) {
 		cp := r.FormValue("confirmPassword")
 
 		// Check if the supplied email already exists.
-		// If it does return to the signup page and present the error.
+		// If it does, flash the error and redirect back to the signup
+		// page rather than re-rendering inline, so a page refresh
+		// doesn't resubmit the form.
 		err := usersDB.CheckEmailExists(e)
 		if err != nil {
-			tpl.ExecuteTemplate(w, "signup.html", struct {
-				Error string
-			}{
-				err.Error(),
-			})
+			flashAndRedirect(w, r, "/signup", err.Error())
 			return
 		}
 
@@ -108,14 +236,13 @@ func signup(w http.ResponseWriter, r *http.Request) {
 		// Then redirect.
 		id, err := usersDB.Add(e, f, l, p, cp)
 		if err != nil {
-			tpl.ExecuteTemplate(w, "signup.html", struct {
-				Error string
-			}{
-				err.Error(),
-			})
+			flashAndRedirect(w, r, "/signup", err.Error())
 			return
 		}
-		err = sessionDB.Create(w, r, id)
+		// Regenerate (rather than reuse) the session so that any
+		// pre-auth session identifier an attacker may have fixated is
+		// invalidated the moment the user authenticates.
+		_, err = sessionStore.Regenerate(w, r, id)
 		if err != nil {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		}
@@ -123,15 +250,30 @@ func signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Return the signup page.
-	tpl.ExecuteTemplate(w, "signup.html", nil)
+	// Return the signup page, with a (possibly fresh) session to carry
+	// its CSRF token and any flashed error from a failed submission.
+	s, err := ensureAnonymousSession(w, r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	errs, _ := sessionStore.ConsumeFlashes(r, "error")
+	tpl.ExecuteTemplate(w, "signup.html", struct {
+		Session *Session
+		Errors  []string
+	}{
+		s,
+		errs,
+	})
 }
 
 // login route handler.
 func login(w http.ResponseWriter, r *http.Request) {
+	next := loginRedirectTarget(r)
+
 	// If the user is already authenticated then redirect.
-	if ok := sessionDB.IsAuthenticated(w, r); ok {
-		http.Redirect(w, r, "/account", http.StatusSeeOther)
+	if UserFromContext(r.Context()) != nil {
+		http.Redirect(w, r, next, http.StatusSeeOther)
 		return
 	}
 
@@ -139,74 +281,80 @@ func login(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
 		e := r.FormValue("email")
 		p := r.FormValue("password")
+		ip := clientIP(r)
+
+		// Refuse to even check the password once this email or IP has
+		// failed too many times recently, so a brute-force or
+		// credential-stuffing run can't burn through guesses.
+		if allowed, retryAfter := loginThrottle.Allow(e, ip); !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
 
-		// Attempt to login using the supplied credentials.
-		// Return the login page with an error if they are invalid.
+		// Attempt to login using the supplied credentials. Flash the
+		// error and redirect back to the login page if they are
+		// invalid, rather than re-rendering inline, so a page refresh
+		// doesn't resubmit the form.
 		u, err := usersDB.Login(e, p)
 		if err != nil {
-			tpl.ExecuteTemplate(w, "login.html", struct {
-				Error string
-			}{
-				err.Error(),
-			})
+			loginThrottle.RecordFailure(e, ip)
+			flashAndRedirect(w, r, loginPath(next), err.Error())
 			return
 		}
+		loginThrottle.Reset(e, ip)
 
-		// Otherwise create a session and cookie
-		err = sessionDB.Create(w, r, u.UserID)
+		// Regenerate (rather than reuse) the session so that any
+		// pre-auth session identifier an attacker may have fixated is
+		// invalidated the moment the user authenticates.
+		_, err = sessionStore.Regenerate(w, r, u.UserID)
 		if err != nil {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		}
-		// Then redirect.
-		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		// Then redirect back to wherever RequireAuth sent the user from,
+		// or /account if they landed here directly.
+		http.Redirect(w, r, next, http.StatusSeeOther)
 		return
 	}
 
-	// Return the login page.
-	tpl.ExecuteTemplate(w, "login.html", nil)
+	// Return the login page, with a (possibly fresh) session to carry
+	// its CSRF token and any flashed error from a failed submission.
+	s, err := ensureAnonymousSession(w, r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	errs, _ := sessionStore.ConsumeFlashes(r, "error")
+	tpl.ExecuteTemplate(w, "login.html", struct {
+		Session *Session
+		Errors  []string
+	}{
+		s,
+		errs,
+	})
 }
 
-// logout route handler.
+// logout route handler. RequireAuth guarantees the request is
+// authenticated before this runs.
 func logout(w http.ResponseWriter, r *http.Request) {
-	// If the user is not authenticated then redirect.
-	if ok := sessionDB.IsAuthenticated(w, r); !ok {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
-	}
 	// Delete the session
-	err := sessionDB.Delete(w, r)
-	if err != nil {
+	if err := sessionStore.Delete(w, r); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 	// Redirect back home.
 	http.Redirect(w, r, "/", http.StatusSeeOther)
-	return
-
 }
 
-// account route handler.
+// account route handler. RequireAuth guarantees the request is
+// authenticated before this runs, so this is pure rendering.
 func account(w http.ResponseWriter, r *http.Request) {
-	// If the user is not authenticated then return a 401.
-	if ok := sessionDB.IsAuthenticated(w, r); !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// Get the user out of the session
-	u, s, err := getUserAndSessionFromSessionCookie(r)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	// Return the account page.
 	tpl.ExecuteTemplate(w, "account.html", struct {
 		User       *User
 		Session    *Session
 		IsLoggedIn bool
 	}{
-		u,
-		s,
+		UserFromContext(r.Context()),
+		SessionFromContext(r.Context()),
 		true,
 	})
 }
@@ -1,113 +1,76 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"log"
 	"net/http"
 	"time"
-
-	uuid "github.com/satori/go.uuid"
 )
 
-// Most of the functionality here should be calling out to a database.
-// Everything is currently done in memory for example purposes.
-
 // MaxSessionAge defines the maximum age of the session in seconds.
 const MaxSessionAge = 300
 
-// SessionDB describes a SessionDB object.
-type SessionDB struct {
-	sessions map[string]Session
-}
-
-// Get a Session from the database from a supplied sessionID.
-// Returns a pointer to a Session.
-func (db *SessionDB) Get(sessionID string) (*Session, error) {
-	if s, ok := db.sessions[sessionID]; ok {
-		return &s, nil
-	}
-	return nil, ErrorSessionDoesntExist{}
-}
-
-// Create will create a new session in the database using the supplied id as a key.
-// Also sets a cookie in the response.
-func (db *SessionDB) Create(w http.ResponseWriter, r *http.Request, id int) error {
-	// Create a new session and add it to the database.
-	s := Session{
-		SessionID: uuid.NewV4().String(),
-		Time:      time.Now(),
-		UserID:    id,
-	}
-	db.sessions[s.SessionID] = s
-
-	// Create a new cookie.
-	c := &http.Cookie{
-		Name:   "session",
-		Value:  s.SessionID,
-		MaxAge: MaxSessionAge,
-		//Secure:   true,
-		HttpOnly: true,
-	}
-	// Add the cookie to the response.
-	http.SetCookie(w, c)
-	return nil
-}
-
-// Delete a session from the database.
-// Reads the session cookie from the request to obtain the session id.
-// Sets a new cookie which will expire.
-func (db *SessionDB) Delete(w http.ResponseWriter, r *http.Request) error {
-
-	// Get the Session from the SessionID in the cookie
-	c, err := r.Cookie("session")
-	if err != nil {
-		return err
-	}
-
-	// Delete the session
-	delete(db.sessions, c.Value)
-
-	// Return an expired cookie
-	nc := &http.Cookie{
-		Name:   "session",
-		Value:  c.Value,
-		MaxAge: -1,
-		//Secure:   true,
-		HttpOnly: true,
-	}
-	http.SetCookie(w, nc)
-	return nil
-}
-
-// Extend will extend the current session to the MaxSessionAge.
-// Reads the current session from the request and returns and updated cookie.
-func (db *SessionDB) Extend(w http.ResponseWriter, r *http.Request) error {
-	// Get the Session from the SessionID in the cookie
-	c, err := r.Cookie("session")
-	if err != nil {
-		return err
-	}
-
-	// Find the session and reset the time.
-	if s, ok := db.sessions[c.Value]; ok {
-		s.Time = time.Now()
-		db.sessions[c.Value] = s
-	}
-
-	// Return an extended cookie
-	nc := &http.Cookie{
-		Name:   "session",
-		Value:  db.sessions[c.Value].SessionID,
-		MaxAge: MaxSessionAge,
-		//Secure:   true,
-		HttpOnly: true,
-	}
-	http.SetCookie(w, nc)
-	return nil
+// SessionStore describes anything capable of persisting sessions.
+// Implementations are free to keep sessions in memory, in an external
+// cache such as Redis, or on disk, as long as expired sessions are
+// eventually reclaimed.
+type SessionStore interface {
+	// Get returns a Session from the store for the supplied sessionID.
+	Get(sessionID string) (*Session, error)
+
+	// Create creates a new session for the supplied user id, sets the
+	// session cookie on the response, persists the session and returns
+	// it.
+	Create(w http.ResponseWriter, r *http.Request, id int) (*Session, error)
+
+	// Delete removes the session referenced by the request's session
+	// cookie and expires that cookie.
+	Delete(w http.ResponseWriter, r *http.Request) error
+
+	// Extend resets the age of the session referenced by the request's
+	// session cookie and reissues the cookie with a fresh MaxAge.
+	Extend(w http.ResponseWriter, r *http.Request) error
+
+	// Touch bumps the last-seen time (and, where relevant, the backend
+	// TTL) of the session identified by sessionID without touching any
+	// cookie. Used internally by Extend and by backends that need to
+	// refresh their own expiry bookkeeping.
+	Touch(sessionID string) error
+
+	// Purge removes every expired session from the store and returns
+	// how many were removed. Stores backed by something with native TTL
+	// support (e.g. Redis) may simply return 0, nil.
+	Purge() (int, error)
+
+	// Regenerate invalidates the session referenced by the request's
+	// session cookie (if any) and issues a brand new one for userID,
+	// rewriting the cookie. Call this whenever a client's privilege
+	// changes (e.g. on login or signup) so that a session identifier an
+	// attacker may have fixated before authentication is useless
+	// afterwards.
+	Regenerate(w http.ResponseWriter, r *http.Request, userID int) (*Session, error)
+
+	// RegenerateAll invalidates every session belonging to userID, for
+	// example to support a "log out everywhere" or password-change
+	// flow, and returns how many were purged. Stores with no way to
+	// enumerate sessions by user may return an error instead.
+	RegenerateAll(userID int) (int, error)
+
+	// AddFlash appends msg to the named flash bucket on the session
+	// referenced by the request's session cookie.
+	AddFlash(r *http.Request, key string, msg string) error
+
+	// ConsumeFlashes returns every flash message queued under key on the
+	// session referenced by the request's session cookie, clearing them
+	// so each is only ever seen once.
+	ConsumeFlashes(r *http.Request, key string) ([]string, error)
 }
 
-// IsAuthenticated will check if a user is authenticated.
-// If true then also extend the session.
-func (db *SessionDB) IsAuthenticated(w http.ResponseWriter, r *http.Request) bool {
+// IsAuthenticated checks if the request carries a valid session cookie
+// against the supplied store. If the session is valid it is also
+// extended.
+func IsAuthenticated(store SessionStore, w http.ResponseWriter, r *http.Request) bool {
 	// Check if the request has a session cookie.
 	// If there is no cookie then return false.
 	c, err := r.Cookie("session")
@@ -117,13 +80,13 @@ func (db *SessionDB) IsAuthenticated(w http.ResponseWriter, r *http.Request) boo
 
 	// Check if the sessionid in the cookie is valid.
 	// If it is not valid return false.
-	_, err = db.Get(c.Value)
+	_, err = store.Get(c.Value)
 	if err != nil {
 		return false
 	}
 
 	// Otherwise the session must be valid. Extend it then return true
-	err = db.Extend(w, r)
+	err = store.Extend(w, r)
 	if err != nil {
 		log.Println("Unable to extend session:", err)
 	}
@@ -135,6 +98,33 @@ type Session struct {
 	SessionID string
 	Time      time.Time
 	UserID    int
+	XSRFToken string
+	Flashes   map[string][]string
+}
+
+// Expired reports whether the session is older than MaxSessionAge.
+func (s Session) Expired() bool {
+	return time.Since(s.Time) > MaxSessionAge*time.Second
+}
+
+// newSessionCookie builds the session cookie for the given session id.
+func newSessionCookie(sessionID string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:   "session",
+		Value:  sessionID,
+		MaxAge: maxAge,
+		//Secure:   true,
+		HttpOnly: true,
+	}
+}
+
+// newXSRFToken returns a fresh, hex-encoded CSRF token for a Session.
+func newXSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 type ErrorSessionDoesntExist struct {
@@ -143,3 +133,13 @@ type ErrorSessionDoesntExist struct {
 func (ErrorSessionDoesntExist) Error() string {
 	return "Session does not exist"
 }
+
+// ErrorRegenerateAllUnsupported is returned by stores that have no way
+// to enumerate a user's sessions, and so cannot implement
+// RegenerateAll.
+type ErrorRegenerateAllUnsupported struct {
+}
+
+func (ErrorRegenerateAllUnsupported) Error() string {
+	return "This session store cannot enumerate sessions by user."
+}
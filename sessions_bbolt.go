@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// bboltSessionBucket is the bucket sessions are stored in.
+var bboltSessionBucket = []byte("sessions")
+
+// bboltSweepInterval controls how often the background sweeper checks
+// for expired sessions.
+const bboltSweepInterval = 30 * time.Second
+
+// bboltXSRFTokenLen is the length in bytes of the hex-encoded CSRF
+// token stored alongside each session record.
+const bboltXSRFTokenLen = 64
+
+// BboltSessionStore is a SessionStore backed by a bbolt file on disk.
+// Each record is stored keyed by session id as a fixed-size header
+// (expire uint32, userID uint64) followed by the session's hex-encoded
+// CSRF token and a trailing JSON-encoded flash message map; a background
+// goroutine sweeps expired entries since bbolt has no native TTL
+// support.
+type BboltSessionStore struct {
+	db   *bolt.DB
+	stop chan struct{}
+}
+
+// NewBboltSessionStore opens (creating if necessary) a bbolt database at
+// path and starts its background sweeper.
+func NewBboltSessionStore(path string) (*BboltSessionStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bboltSessionBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &BboltSessionStore{db: db, stop: make(chan struct{})}
+	go store.sweep()
+	return store, nil
+}
+
+// Close stops the sweeper and closes the underlying database.
+func (db *BboltSessionStore) Close() error {
+	close(db.stop)
+	return db.db.Close()
+}
+
+// Get a Session from the database from a supplied sessionID.
+func (db *BboltSessionStore) Get(sessionID string) (*Session, error) {
+	var s Session
+	err := db.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bboltSessionBucket).Get([]byte(sessionID))
+		if v == nil {
+			return ErrorSessionDoesntExist{}
+		}
+		rec, err := decodeSessionRecord(v)
+		if err != nil {
+			return err
+		}
+		if time.Now().Unix() > rec.expire {
+			return ErrorSessionDoesntExist{}
+		}
+		s = Session{
+			SessionID: sessionID,
+			Time:      time.Unix(rec.expire-MaxSessionAge, 0),
+			UserID:    int(rec.userID),
+			XSRFToken: rec.token,
+			Flashes:   rec.flashes,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Create will create a new session in the database using a freshly
+// generated id as a key. Also sets a cookie in the response.
+func (db *BboltSessionStore) Create(w http.ResponseWriter, r *http.Request, id int) (*Session, error) {
+	token, err := newXSRFToken()
+	if err != nil {
+		return nil, err
+	}
+
+	sessionID := uuid.NewV4().String()
+	now := time.Now()
+	expire := now.Add(MaxSessionAge * time.Second).Unix()
+
+	rec := bboltRecord{expire: expire, userID: uint64(id), token: token}
+	data, err := encodeSessionRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bboltSessionBucket).Put([]byte(sessionID), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	http.SetCookie(w, newSessionCookie(sessionID, MaxSessionAge))
+	return &Session{SessionID: sessionID, Time: now, UserID: id, XSRFToken: token}, nil
+}
+
+// Delete a session from the database.
+func (db *BboltSessionStore) Delete(w http.ResponseWriter, r *http.Request) error {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return err
+	}
+
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bboltSessionBucket).Delete([]byte(c.Value))
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, newSessionCookie(c.Value, -1))
+	return nil
+}
+
+// Extend will extend the current session to the MaxSessionAge.
+func (db *BboltSessionStore) Extend(w http.ResponseWriter, r *http.Request) error {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return err
+	}
+
+	if err := db.Touch(c.Value); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, newSessionCookie(c.Value, MaxSessionAge))
+	return nil
+}
+
+// Touch rewrites the expiry of the session identified by sessionID.
+func (db *BboltSessionStore) Touch(sessionID string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bboltSessionBucket)
+		v := b.Get([]byte(sessionID))
+		if v == nil {
+			return ErrorSessionDoesntExist{}
+		}
+		rec, err := decodeSessionRecord(v)
+		if err != nil {
+			return err
+		}
+		rec.expire = time.Now().Add(MaxSessionAge * time.Second).Unix()
+		data, err := encodeSessionRecord(rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(sessionID), data)
+	})
+}
+
+// Purge removes every expired session from the bucket and returns how
+// many were removed.
+func (db *BboltSessionStore) Purge() (int, error) {
+	purged := 0
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bboltSessionBucket)
+		now := time.Now().Unix()
+		var expiredKeys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			rec, err := decodeSessionRecord(v)
+			if err != nil {
+				return err
+			}
+			if now > rec.expire {
+				expiredKeys = append(expiredKeys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expiredKeys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// Regenerate deletes the session referenced by the request's session
+// cookie, if any, and creates a fresh one for userID.
+func (db *BboltSessionStore) Regenerate(w http.ResponseWriter, r *http.Request, userID int) (*Session, error) {
+	if c, err := r.Cookie("session"); err == nil {
+		_ = db.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bboltSessionBucket).Delete([]byte(c.Value))
+		})
+	}
+	return db.Create(w, r, userID)
+}
+
+// RegenerateAll deletes every session belonging to userID.
+func (db *BboltSessionStore) RegenerateAll(userID int) (int, error) {
+	purged := 0
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bboltSessionBucket)
+		var matchingKeys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			rec, err := decodeSessionRecord(v)
+			if err != nil {
+				return err
+			}
+			if rec.userID == uint64(userID) {
+				matchingKeys = append(matchingKeys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range matchingKeys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// AddFlash appends msg to the named flash bucket on the session
+// referenced by the request's session cookie.
+func (db *BboltSessionStore) AddFlash(r *http.Request, key string, msg string) error {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return err
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bboltSessionBucket)
+		v := b.Get([]byte(c.Value))
+		if v == nil {
+			return ErrorSessionDoesntExist{}
+		}
+		rec, err := decodeSessionRecord(v)
+		if err != nil {
+			return err
+		}
+		if rec.flashes == nil {
+			rec.flashes = map[string][]string{}
+		}
+		rec.flashes[key] = append(rec.flashes[key], msg)
+		data, err := encodeSessionRecord(rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(c.Value), data)
+	})
+}
+
+// ConsumeFlashes returns and clears every flash message queued under key.
+func (db *BboltSessionStore) ConsumeFlashes(r *http.Request, key string) ([]string, error) {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return nil, err
+	}
+	var msgs []string
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bboltSessionBucket)
+		v := b.Get([]byte(c.Value))
+		if v == nil {
+			return ErrorSessionDoesntExist{}
+		}
+		rec, err := decodeSessionRecord(v)
+		if err != nil {
+			return err
+		}
+		msgs = rec.flashes[key]
+		if len(msgs) == 0 {
+			return nil
+		}
+		delete(rec.flashes, key)
+		data, err := encodeSessionRecord(rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(c.Value), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// sweep periodically purges expired sessions until the store is closed.
+func (db *BboltSessionStore) sweep() {
+	ticker := time.NewTicker(bboltSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n, err := db.Purge(); err != nil {
+				log.Println("bbolt session sweep failed:", err)
+			} else if n > 0 {
+				log.Println("bbolt session sweep purged", n, "expired sessions")
+			}
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+// bboltRecord is the decoded form of a bbolt session value.
+type bboltRecord struct {
+	expire  int64
+	userID  uint64
+	token   string
+	flashes map[string][]string
+}
+
+// encodeSessionRecord packs a bboltRecord into bbolt's stored value
+// format: a 4-byte expire (unix seconds) followed by an 8-byte userID,
+// both big-endian, followed by the hex-encoded CSRF token, followed by
+// the JSON encoding of the flash message map.
+func encodeSessionRecord(rec bboltRecord) ([]byte, error) {
+	flashes, err := json.Marshal(rec.flashes)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 12+bboltXSRFTokenLen+len(flashes))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(rec.expire))
+	binary.BigEndian.PutUint64(buf[4:12], rec.userID)
+	copy(buf[12:12+bboltXSRFTokenLen], rec.token)
+	copy(buf[12+bboltXSRFTokenLen:], flashes)
+	return buf, nil
+}
+
+// decodeSessionRecord is the inverse of encodeSessionRecord.
+func decodeSessionRecord(buf []byte) (bboltRecord, error) {
+	rec := bboltRecord{
+		expire: int64(binary.BigEndian.Uint32(buf[0:4])),
+		userID: binary.BigEndian.Uint64(buf[4:12]),
+		token:  string(buf[12 : 12+bboltXSRFTokenLen]),
+	}
+	if err := json.Unmarshal(buf[12+bboltXSRFTokenLen:], &rec.flashes); err != nil {
+		return bboltRecord{}, err
+	}
+	return rec, nil
+}
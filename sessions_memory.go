@@ -0,0 +1,240 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// memorySweepInterval controls how often the background sweeper checks
+// for expired sessions.
+const memorySweepInterval = 30 * time.Second
+
+// MemorySessionStore is a SessionStore backed by a plain in-memory map.
+// Sessions do not survive a process restart and are only visible to the
+// process that created them; it exists mainly for local development and
+// the other stores should be preferred in production. The map is guarded
+// by mu since it is shared across the goroutine-per-request net/http
+// spawns, and a background goroutine sweeps expired entries since
+// nothing else reclaims them.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]Session
+	stop     chan struct{}
+}
+
+// NewMemorySessionStore returns an initialised MemorySessionStore and
+// starts its background sweeper.
+func NewMemorySessionStore() *MemorySessionStore {
+	db := &MemorySessionStore{
+		sessions: map[string]Session{},
+		stop:     make(chan struct{}),
+	}
+	go db.sweep()
+	return db
+}
+
+// Close stops the sweeper.
+func (db *MemorySessionStore) Close() {
+	close(db.stop)
+}
+
+// Get a Session from the database from a supplied sessionID.
+// Returns a pointer to a Session.
+func (db *MemorySessionStore) Get(sessionID string) (*Session, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	s, ok := db.sessions[sessionID]
+	if !ok || s.Expired() {
+		return nil, ErrorSessionDoesntExist{}
+	}
+	return &s, nil
+}
+
+// Create will create a new session in the database using a freshly
+// generated id as a key. Also sets a cookie in the response.
+func (db *MemorySessionStore) Create(w http.ResponseWriter, r *http.Request, id int) (*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.createLocked(w, id)
+}
+
+// createLocked creates and stores a new session for id. Callers must hold
+// db.mu.
+func (db *MemorySessionStore) createLocked(w http.ResponseWriter, id int) (*Session, error) {
+	token, err := newXSRFToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a new session and add it to the database.
+	s := Session{
+		SessionID: uuid.NewV4().String(),
+		Time:      time.Now(),
+		UserID:    id,
+		XSRFToken: token,
+	}
+	db.sessions[s.SessionID] = s
+
+	// Add the cookie to the response.
+	http.SetCookie(w, newSessionCookie(s.SessionID, MaxSessionAge))
+	return &s, nil
+}
+
+// Delete a session from the database.
+// Reads the session cookie from the request to obtain the session id.
+// Sets a new cookie which will expire.
+func (db *MemorySessionStore) Delete(w http.ResponseWriter, r *http.Request) error {
+	// Get the Session from the SessionID in the cookie
+	c, err := r.Cookie("session")
+	if err != nil {
+		return err
+	}
+
+	// Delete the session
+	db.mu.Lock()
+	delete(db.sessions, c.Value)
+	db.mu.Unlock()
+
+	// Return an expired cookie
+	http.SetCookie(w, newSessionCookie(c.Value, -1))
+	return nil
+}
+
+// Extend will extend the current session to the MaxSessionAge.
+// Reads the current session from the request and returns and updated cookie.
+func (db *MemorySessionStore) Extend(w http.ResponseWriter, r *http.Request) error {
+	// Get the Session from the SessionID in the cookie
+	c, err := r.Cookie("session")
+	if err != nil {
+		return err
+	}
+
+	if err := db.Touch(c.Value); err != nil {
+		return err
+	}
+
+	// Return an extended cookie
+	http.SetCookie(w, newSessionCookie(c.Value, MaxSessionAge))
+	return nil
+}
+
+// Touch resets the time of the session identified by sessionID.
+func (db *MemorySessionStore) Touch(sessionID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.touchLocked(sessionID)
+}
+
+// touchLocked resets the time of the session identified by sessionID.
+// Callers must hold db.mu.
+func (db *MemorySessionStore) touchLocked(sessionID string) error {
+	s, ok := db.sessions[sessionID]
+	if !ok {
+		return ErrorSessionDoesntExist{}
+	}
+	s.Time = time.Now()
+	db.sessions[sessionID] = s
+	return nil
+}
+
+// Purge removes every expired session from the map.
+func (db *MemorySessionStore) Purge() (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	purged := 0
+	for id, s := range db.sessions {
+		if s.Expired() {
+			delete(db.sessions, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// Regenerate deletes the session referenced by the request's session
+// cookie, if any, and creates a fresh one for userID.
+func (db *MemorySessionStore) Regenerate(w http.ResponseWriter, r *http.Request, userID int) (*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if c, err := r.Cookie("session"); err == nil {
+		delete(db.sessions, c.Value)
+	}
+	return db.createLocked(w, userID)
+}
+
+// RegenerateAll deletes every session belonging to userID.
+func (db *MemorySessionStore) RegenerateAll(userID int) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	purged := 0
+	for id, s := range db.sessions {
+		if s.UserID == userID {
+			delete(db.sessions, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// AddFlash appends msg to the named flash bucket on the session
+// referenced by the request's session cookie.
+func (db *MemorySessionStore) AddFlash(r *http.Request, key string, msg string) error {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s, ok := db.sessions[c.Value]
+	if !ok {
+		return ErrorSessionDoesntExist{}
+	}
+	if s.Flashes == nil {
+		s.Flashes = map[string][]string{}
+	}
+	s.Flashes[key] = append(s.Flashes[key], msg)
+	db.sessions[c.Value] = s
+	return nil
+}
+
+// ConsumeFlashes returns and clears every flash message queued under key.
+func (db *MemorySessionStore) ConsumeFlashes(r *http.Request, key string) ([]string, error) {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s, ok := db.sessions[c.Value]
+	if !ok {
+		return nil, ErrorSessionDoesntExist{}
+	}
+	msgs := s.Flashes[key]
+	if len(msgs) > 0 {
+		delete(s.Flashes, key)
+		db.sessions[c.Value] = s
+	}
+	return msgs, nil
+}
+
+// sweep periodically purges expired sessions until the store is closed.
+func (db *MemorySessionStore) sweep() {
+	ticker := time.NewTicker(memorySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n, err := db.Purge(); err != nil {
+				log.Println("memory session sweep failed:", err)
+			} else if n > 0 {
+				log.Println("memory session sweep purged", n, "expired sessions")
+			}
+		case <-db.stop:
+			return
+		}
+	}
+}
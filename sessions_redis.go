@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	uuid "github.com/satori/go.uuid"
+)
+
+// redisSessionPrefix namespaces session keys within the Redis keyspace.
+const redisSessionPrefix = "session:"
+
+// RedisSessionStore is a SessionStore backed by Redis. Sessions are
+// stored as JSON under a per-key TTL matching MaxSessionAge, so
+// expiration is enforced by Redis itself rather than Purge.
+type RedisSessionStore struct {
+	client *redis.Client
+}
+
+// NewRedisSessionStore returns a RedisSessionStore talking to the Redis
+// instance at addr.
+func NewRedisSessionStore(addr string) *RedisSessionStore {
+	return &RedisSessionStore{
+		client: redis.NewClient(&redis.Options{Addr: addr}),
+	}
+}
+
+// Get a Session from Redis for the supplied sessionID.
+func (db *RedisSessionStore) Get(sessionID string) (*Session, error) {
+	data, err := db.client.Get(context.Background(), redisSessionPrefix+sessionID).Bytes()
+	if err == redis.Nil {
+		return nil, ErrorSessionDoesntExist{}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Create will create a new session in Redis using a freshly generated id
+// as a key. Also sets a cookie in the response.
+func (db *RedisSessionStore) Create(w http.ResponseWriter, r *http.Request, id int) (*Session, error) {
+	token, err := newXSRFToken()
+	if err != nil {
+		return nil, err
+	}
+
+	s := Session{
+		SessionID: uuid.NewV4().String(),
+		Time:      time.Now(),
+		UserID:    id,
+		XSRFToken: token,
+	}
+	if err := db.set(s); err != nil {
+		return nil, err
+	}
+
+	http.SetCookie(w, newSessionCookie(s.SessionID, MaxSessionAge))
+	return &s, nil
+}
+
+// Delete removes the session referenced by the request's session cookie
+// from Redis and expires that cookie.
+func (db *RedisSessionStore) Delete(w http.ResponseWriter, r *http.Request) error {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return err
+	}
+
+	if err := db.client.Del(context.Background(), redisSessionPrefix+c.Value).Err(); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, newSessionCookie(c.Value, -1))
+	return nil
+}
+
+// Extend will extend the current session to the MaxSessionAge.
+func (db *RedisSessionStore) Extend(w http.ResponseWriter, r *http.Request) error {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return err
+	}
+
+	if err := db.Touch(c.Value); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, newSessionCookie(c.Value, MaxSessionAge))
+	return nil
+}
+
+// Touch refreshes the stored Time and the key's TTL for sessionID.
+func (db *RedisSessionStore) Touch(sessionID string) error {
+	s, err := db.Get(sessionID)
+	if err != nil {
+		return err
+	}
+	s.Time = time.Now()
+	return db.set(*s)
+}
+
+// Purge is a no-op for Redis: expiration is enforced by the per-key TTL.
+func (db *RedisSessionStore) Purge() (int, error) {
+	return 0, nil
+}
+
+// Regenerate deletes the session referenced by the request's session
+// cookie, if any, and creates a fresh one for userID.
+func (db *RedisSessionStore) Regenerate(w http.ResponseWriter, r *http.Request, userID int) (*Session, error) {
+	if c, err := r.Cookie("session"); err == nil {
+		db.client.Del(context.Background(), redisSessionPrefix+c.Value)
+	}
+	return db.Create(w, r, userID)
+}
+
+// RegenerateAll scans every session key and deletes those belonging to
+// userID.
+func (db *RedisSessionStore) RegenerateAll(userID int) (int, error) {
+	ctx := context.Background()
+	purged := 0
+	iter := db.client.Scan(ctx, 0, redisSessionPrefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		data, err := db.client.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			continue
+		}
+		var s Session
+		if err := json.Unmarshal(data, &s); err != nil {
+			continue
+		}
+		if s.UserID == userID {
+			if err := db.client.Del(ctx, iter.Val()).Err(); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+	}
+	return purged, iter.Err()
+}
+
+// AddFlash appends msg to the named flash bucket on the session
+// referenced by the request's session cookie.
+func (db *RedisSessionStore) AddFlash(r *http.Request, key string, msg string) error {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return err
+	}
+	s, err := db.Get(c.Value)
+	if err != nil {
+		return err
+	}
+	if s.Flashes == nil {
+		s.Flashes = map[string][]string{}
+	}
+	s.Flashes[key] = append(s.Flashes[key], msg)
+	return db.set(*s)
+}
+
+// ConsumeFlashes returns and clears every flash message queued under key.
+func (db *RedisSessionStore) ConsumeFlashes(r *http.Request, key string) ([]string, error) {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return nil, err
+	}
+	s, err := db.Get(c.Value)
+	if err != nil {
+		return nil, err
+	}
+	msgs := s.Flashes[key]
+	if len(msgs) > 0 {
+		delete(s.Flashes, key)
+		if err := db.set(*s); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+// set serialises s as JSON and stores it under its own TTL.
+func (db *RedisSessionStore) set(s Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return db.client.Set(context.Background(), redisSessionPrefix+s.SessionID, data, MaxSessionAge*time.Second).Err()
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// StatelessSessionDB is a SessionStore that keeps no server-side state at
+// all: the session payload is encoded directly into the cookie value,
+// HMAC-signed and optionally AES-GCM encrypted. This lets the app scale
+// horizontally without a shared session backend.
+//
+// SigningKeys and EncryptionKeys support rotation: the first key in each
+// slice is used when signing/encrypting new cookies, but every key in
+// the slice is tried when verifying/decrypting an existing one, so old
+// cookies keep working while a key is being rotated out.
+type StatelessSessionDB struct {
+	SigningKeys    [][]byte
+	EncryptionKeys [][]byte
+}
+
+// statelessPayload is the data encoded into the cookie value.
+type statelessPayload struct {
+	UserID    int    `json:"uid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Nonce     string `json:"n"`
+	XSRFToken string `json:"x"`
+}
+
+// Get decodes, verifies and (if configured) decrypts the supplied cookie
+// value and returns the Session it encodes.
+func (db *StatelessSessionDB) Get(sessionID string) (*Session, error) {
+	p, err := db.decode(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > p.ExpiresAt {
+		return nil, ErrorSessionDoesntExist{}
+	}
+	return &Session{
+		SessionID: sessionID,
+		Time:      time.Unix(p.IssuedAt, 0),
+		UserID:    p.UserID,
+		XSRFToken: p.XSRFToken,
+	}, nil
+}
+
+// Create encodes a new payload for the supplied user id and sets it as
+// the session cookie. Nothing is persisted server-side.
+func (db *StatelessSessionDB) Create(w http.ResponseWriter, r *http.Request, id int) (*Session, error) {
+	now := time.Now()
+	nonce, err := randomNonce()
+	if err != nil {
+		return nil, err
+	}
+	token, err := newXSRFToken()
+	if err != nil {
+		return nil, err
+	}
+	p := statelessPayload{
+		UserID:    id,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(MaxSessionAge * time.Second).Unix(),
+		Nonce:     nonce,
+		XSRFToken: token,
+	}
+	value, err := db.encode(p)
+	if err != nil {
+		return nil, err
+	}
+
+	http.SetCookie(w, newSessionCookie(value, MaxSessionAge))
+	return &Session{SessionID: value, Time: now, UserID: id, XSRFToken: token}, nil
+}
+
+// Delete clears the session cookie. There is nothing to remove
+// server-side since the session lives entirely in the cookie.
+func (db *StatelessSessionDB) Delete(w http.ResponseWriter, r *http.Request) error {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, newSessionCookie(c.Value, -1))
+	return nil
+}
+
+// Extend re-issues the session cookie with a refreshed expiry, keeping
+// the same user id.
+func (db *StatelessSessionDB) Extend(w http.ResponseWriter, r *http.Request) error {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return err
+	}
+	p, err := db.decode(c.Value)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	value, err := db.encode(statelessPayload{
+		UserID:    p.UserID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(MaxSessionAge * time.Second).Unix(),
+		Nonce:     p.Nonce,
+		XSRFToken: p.XSRFToken,
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, newSessionCookie(value, MaxSessionAge))
+	return nil
+}
+
+// Touch verifies that sessionID decodes and is still within its expiry.
+// There is no server-side record to update; this exists to satisfy
+// SessionStore and for callers that want a cheap validity check.
+func (db *StatelessSessionDB) Touch(sessionID string) error {
+	_, err := db.Get(sessionID)
+	return err
+}
+
+// Purge is a no-op: stateless sessions expire on their own the next time
+// they are decoded, there is nothing for the server to reclaim.
+func (db *StatelessSessionDB) Purge() (int, error) {
+	return 0, nil
+}
+
+// Regenerate mints a brand new signed (and possibly encrypted) cookie
+// for userID. There is nothing stored server-side to invalidate; any
+// previously issued cookie remains cryptographically valid until it
+// expires on its own.
+func (db *StatelessSessionDB) Regenerate(w http.ResponseWriter, r *http.Request, userID int) (*Session, error) {
+	return db.Create(w, r, userID)
+}
+
+// RegenerateAll is unsupported: a stateless store has no server-side
+// record of which cookies exist, so there is nothing to enumerate by
+// user.
+func (db *StatelessSessionDB) RegenerateAll(userID int) (int, error) {
+	return 0, ErrorRegenerateAllUnsupported{}
+}
+
+// AddFlash is unsupported: the session cookie is immutable to this
+// method (it takes no http.ResponseWriter to reissue it), so there is
+// nowhere to store the flash.
+func (db *StatelessSessionDB) AddFlash(r *http.Request, key string, msg string) error {
+	return ErrorFlashesUnsupported{}
+}
+
+// ConsumeFlashes is unsupported for the same reason as AddFlash.
+func (db *StatelessSessionDB) ConsumeFlashes(r *http.Request, key string) ([]string, error) {
+	return nil, ErrorFlashesUnsupported{}
+}
+
+// encode signs (and optionally encrypts) a payload into a cookie value.
+func (db *StatelessSessionDB) encode(p statelessPayload) (string, error) {
+	if len(db.SigningKeys) == 0 {
+		return "", ErrorNoSigningKey{}
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+
+	if len(db.EncryptionKeys) > 0 {
+		data, err = encrypt(db.EncryptionKeys[0], data)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+	mac := sign(db.SigningKeys[0], encoded)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+// decode verifies the signature against every known signing key, then
+// decrypts (trying every known encryption key) and unmarshals the
+// payload.
+func (db *StatelessSessionDB) decode(value string) (*statelessPayload, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrorSessionDoesntExist{}
+	}
+	encoded, macPart := parts[0], parts[1]
+
+	mac, err := base64.RawURLEncoding.DecodeString(macPart)
+	if err != nil {
+		return nil, ErrorSessionDoesntExist{}
+	}
+	if !verifyAny(db.SigningKeys, encoded, mac) {
+		return nil, ErrorSessionDoesntExist{}
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrorSessionDoesntExist{}
+	}
+
+	if len(db.EncryptionKeys) > 0 {
+		data, err = decryptAny(db.EncryptionKeys, data)
+		if err != nil {
+			return nil, ErrorSessionDoesntExist{}
+		}
+	}
+
+	var p statelessPayload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, ErrorSessionDoesntExist{}
+	}
+	return &p, nil
+}
+
+// sign returns the HMAC-SHA256 of data under key.
+func sign(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// verifyAny reports whether mac is a valid HMAC-SHA256 of data under any
+// of the supplied keys, using a constant-time comparison.
+func verifyAny(keys [][]byte, data string, mac []byte) bool {
+	for _, key := range keys {
+		if hmac.Equal(sign(key, data), mac) {
+			return true
+		}
+	}
+	return false
+}
+
+// encrypt seals plaintext with AES-GCM under key, prefixing the result
+// with a freshly generated nonce.
+func encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decryptAny opens ciphertext with AES-GCM, trying each key in turn.
+func decryptAny(keys [][]byte, ciphertext []byte) ([]byte, error) {
+	var lastErr error = ErrorSessionDoesntExist{}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(ciphertext) < gcm.NonceSize() {
+			continue
+		}
+		nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+		plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return plaintext, nil
+	}
+	return nil, lastErr
+}
+
+// randomNonce returns a hex-encoded 16-byte random value used to keep
+// otherwise-identical payloads from encoding to the same ciphertext.
+func randomNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type ErrorNoSigningKey struct {
+}
+
+func (ErrorNoSigningKey) Error() string {
+	return "No session signing key configured."
+}
+
+// ErrorFlashesUnsupported is returned by stores that have nowhere to
+// durably stash a flash message outside of the response cookie itself.
+type ErrorFlashesUnsupported struct {
+}
+
+func (ErrorFlashesUnsupported) Error() string {
+	return "This session store cannot carry flash messages."
+}
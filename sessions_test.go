@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// sessionStoreFactories returns, for each SessionStore implementation
+// that can be exercised in this environment, a constructor and a matching
+// cleanup function. RedisSessionStore is only included when
+// TEST_REDIS_ADDR points at a reachable instance, since CI/dev boxes
+// won't generally have Redis running.
+func sessionStoreFactories(t *testing.T) map[string]func() (SessionStore, func()) {
+	t.Helper()
+
+	factories := map[string]func() (SessionStore, func()){
+		"memory": func() (SessionStore, func()) {
+			store := NewMemorySessionStore()
+			return store, func() { store.Close() }
+		},
+		"bbolt": func() (SessionStore, func()) {
+			f, err := os.CreateTemp("", "sessions-*.db")
+			if err != nil {
+				t.Fatalf("CreateTemp: %v", err)
+			}
+			path := f.Name()
+			f.Close()
+			os.Remove(path)
+
+			store, err := NewBboltSessionStore(path)
+			if err != nil {
+				t.Fatalf("NewBboltSessionStore: %v", err)
+			}
+			return store, func() {
+				store.Close()
+				os.Remove(path)
+			}
+		},
+		"stateless": func() (SessionStore, func()) {
+			return &StatelessSessionDB{
+				SigningKeys: [][]byte{[]byte("test-signing-key")},
+			}, func() {}
+		},
+	}
+
+	if addr := os.Getenv("TEST_REDIS_ADDR"); addr != "" {
+		factories["redis"] = func() (SessionStore, func()) {
+			return NewRedisSessionStore(addr), func() {}
+		}
+	}
+
+	return factories
+}
+
+// TestSessionStores runs the same conformance checks against every
+// SessionStore implementation available in this environment.
+func TestSessionStores(t *testing.T) {
+	for name, factory := range sessionStoreFactories(t) {
+		name, factory := name, factory
+		t.Run(name, func(t *testing.T) {
+			store, cleanup := factory()
+			defer cleanup()
+			testSessionStoreConformance(t, store)
+		})
+	}
+}
+
+// testSessionStoreConformance exercises Create, Get, Extend, AddFlash,
+// ConsumeFlashes, Regenerate, RegenerateAll, Delete and Purge against
+// store, tolerating the documented "unsupported" errors that
+// RegenerateAll and flashes may return for stores with no server-side
+// record to enumerate or mutate.
+func testSessionStoreConformance(t *testing.T, store SessionStore) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	s, err := store.Create(w, r, 42)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if s.UserID != 42 {
+		t.Fatalf("Create: UserID = %d, want 42", s.UserID)
+	}
+	r = requestWithResponseCookies(r, w)
+
+	got, err := store.Get(s.SessionID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.UserID != 42 {
+		t.Fatalf("Get: UserID = %d, want 42", got.UserID)
+	}
+
+	w = httptest.NewRecorder()
+	if err := store.Extend(w, r); err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+	r = requestWithResponseCookies(r, w)
+
+	switch err := store.AddFlash(r, "error", "oops"); {
+	case err == nil:
+		msgs, err := store.ConsumeFlashes(r, "error")
+		if err != nil {
+			t.Fatalf("ConsumeFlashes: %v", err)
+		}
+		if len(msgs) != 1 || msgs[0] != "oops" {
+			t.Fatalf("ConsumeFlashes = %v, want [oops]", msgs)
+		}
+		// Flashes are read-once: consuming the same key again should
+		// come back empty.
+		msgs, err = store.ConsumeFlashes(r, "error")
+		if err != nil {
+			t.Fatalf("ConsumeFlashes (second read): %v", err)
+		}
+		if len(msgs) != 0 {
+			t.Fatalf("ConsumeFlashes (second read) = %v, want none", msgs)
+		}
+	case !isUnsupported(err):
+		t.Fatalf("AddFlash: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	regenerated, err := store.Regenerate(w, r, 43)
+	if err != nil {
+		t.Fatalf("Regenerate: %v", err)
+	}
+	if regenerated.UserID != 43 {
+		t.Fatalf("Regenerate: UserID = %d, want 43", regenerated.UserID)
+	}
+	if regenerated.SessionID == s.SessionID {
+		t.Fatalf("Regenerate: session id did not change")
+	}
+	oldSessionID := s.SessionID
+	r = requestWithResponseCookies(r, w)
+
+	// StatelessSessionDB keeps no server-side record, so it has no way
+	// to invalidate a previously issued cookie: Regenerate just mints a
+	// new one, and the old cookie stays cryptographically valid until it
+	// expires on its own. Every other backend must invalidate it.
+	if _, ok := store.(*StatelessSessionDB); !ok {
+		if _, err := store.Get(oldSessionID); err == nil {
+			t.Fatalf("Get(oldSessionID): want error after Regenerate, got none")
+		}
+	}
+
+	if _, err := store.RegenerateAll(43); err != nil && !isUnsupported(err) {
+		t.Fatalf("RegenerateAll: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	if err := store.Delete(w, r); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	if _, err := store.Purge(); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+}
+
+// isUnsupported reports whether err is one of the documented
+// capability-not-supported errors a SessionStore implementation may
+// return instead of doing the operation.
+func isUnsupported(err error) bool {
+	switch err.(type) {
+	case ErrorRegenerateAllUnsupported, ErrorFlashesUnsupported:
+		return true
+	default:
+		return false
+	}
+}
+
+// requestWithResponseCookies returns a copy of r carrying every cookie
+// set on w, so a test can chain calls the way a browser would across
+// requests.
+func requestWithResponseCookies(r *http.Request, w *httptest.ResponseRecorder) *http.Request {
+	req := r.Clone(r.Context())
+	req.Header.Del("Cookie")
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}